@@ -1,12 +1,21 @@
 package runtime
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	google_protobuf "github.com/golang/protobuf/ptypes/any"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/status"
@@ -69,91 +78,270 @@ const (
 	DeadlineExceeded = "DEADLINE_EXCEEDED"
 )
 
+// StatusStrings is the gRPC-code-to-canonical-string table consulted by
+// HTTPStatusStringFromCode, exported so logging and tracing middleware can
+// render or parse the same strings this package uses without duplicating
+// the mapping themselves.
+var StatusStrings = map[codes.Code]string{
+	codes.OK:                 OK,
+	codes.Canceled:           Canceled,
+	codes.Unknown:            Unknown,
+	codes.InvalidArgument:    InvalidArgument,
+	codes.DeadlineExceeded:   DeadlineExceeded,
+	codes.NotFound:           NotFound,
+	codes.AlreadyExists:      AlreadyExists,
+	codes.PermissionDenied:   PermissionDenied,
+	codes.Unauthenticated:    Unauthenticated,
+	codes.ResourceExhausted:  ResourceExhausted,
+	codes.FailedPrecondition: FailedPrecondition,
+	codes.Aborted:            Aborted,
+	codes.OutOfRange:         OutOfRange,
+	codes.Unimplemented:      NotImplemented,
+	codes.Internal:           Internal,
+	codes.Unavailable:        Unavailable,
+	codes.DataLoss:           DataLoss,
+}
+
+// CodeFromStatusString is the inverse of StatusStrings, for middleware that
+// needs to parse one of this package's canonical status strings back into a
+// codes.Code.
+func CodeFromStatusString(s string) (codes.Code, bool) {
+	for code, str := range StatusStrings {
+		if str == s {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
 func HTTPStatusStringFromCode(code codes.Code) string {
-	switch code {
-	case codes.OK:
-		return OK
-	case codes.Canceled:
-		return Canceled
-	case codes.Unknown:
-		return Unknown
-	case codes.InvalidArgument:
-		return InvalidArgument
-	case codes.DeadlineExceeded:
-		return DeadlineExceeded
-	case codes.NotFound:
-		return NotFound
-	case codes.AlreadyExists:
-		return AlreadyExists
-	case codes.PermissionDenied:
-		return PermissionDenied
-	case codes.Unauthenticated:
-		return Unauthenticated
-	case codes.ResourceExhausted:
-		return ResourceExhausted
-	case codes.FailedPrecondition:
-		return FailedPrecondition
-	case codes.Aborted:
-		return Aborted
-	case codes.OutOfRange:
-		return OutOfRange
-	case codes.Unimplemented:
-		return NotImplemented
-	case codes.Internal:
-		return Internal
-	case codes.Unavailable:
-		return Unavailable
-	case codes.DataLoss:
-		return DataLoss
+	if s, ok := StatusStrings[code]; ok {
+		return s
 	}
 
 	grpclog.Printf("Unknown gRPC error code: %v", code)
 	return Internal
 }
 
+// MappingProfile selects which gRPC-code-to-HTTP-status table
+// HTTPStatusFromCode consults. Select one with SetMappingProfile.
+type MappingProfile int
+
+const (
+	// ProfileLegacy is this package's original mapping. It remains the
+	// default so existing deployments don't see their HTTP statuses change
+	// underneath them.
+	ProfileLegacy MappingProfile = iota
+	// ProfileGoogleAPIs matches the mapping documented for
+	// google/rpc/code.proto, e.g. 504 Gateway Timeout for
+	// codes.DeadlineExceeded and 429 Too Many Requests for
+	// codes.ResourceExhausted, where ProfileLegacy instead reuses 408 and
+	// 403 respectively.
+	ProfileGoogleAPIs
+)
+
+// legacyHTTPStatusMapping is the table ProfileLegacy installs into
+// HTTPStatusMapping.
+var legacyHTTPStatusMapping = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           http.StatusRequestTimeout,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusRequestTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.ResourceExhausted:  http.StatusForbidden,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+}
+
+// googleAPIsHTTPStatusMapping is the table ProfileGoogleAPIs installs into
+// HTTPStatusMapping.
+var googleAPIsHTTPStatusMapping = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499, // client closed request; googleapis' non-standard convention, no http.Status constant exists
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+}
+
+// HTTPStatusMapping is the gRPC-code-to-HTTP-status table consulted by
+// HTTPStatusFromCode. It starts out as ProfileLegacy; call SetMappingProfile
+// to swap in ProfileGoogleAPIs, or SetHTTPStatusMapping to override a single
+// entry, instead of forking this file. Reads and writes of this var outside
+// SetMappingProfile/SetHTTPStatusMapping/HTTPStatusFromCode are not
+// synchronized with httpStatusMappingMu, so treat direct mutation of the map
+// the same as those two setters: do it during initialization, before any
+// ServeMux starts handling requests.
+var HTTPStatusMapping = cloneStatusMapping(legacyHTTPStatusMapping)
+
+// httpStatusMappingMu guards HTTPStatusMapping against the concurrent
+// read (HTTPStatusFromCode) and writes (SetMappingProfile,
+// SetHTTPStatusMapping) that would otherwise race once a ServeMux is
+// serving requests while another goroutine reconfigures the mapping.
+var httpStatusMappingMu sync.RWMutex
+
+// SetMappingProfile replaces HTTPStatusMapping wholesale with the table for
+// profile. Call it once during initialization, before ServeMux instances
+// start handling requests; any entries previously installed with
+// SetHTTPStatusMapping are discarded.
+func SetMappingProfile(profile MappingProfile) {
+	httpStatusMappingMu.Lock()
+	defer httpStatusMappingMu.Unlock()
+
+	switch profile {
+	case ProfileGoogleAPIs:
+		HTTPStatusMapping = cloneStatusMapping(googleAPIsHTTPStatusMapping)
+	default:
+		HTTPStatusMapping = cloneStatusMapping(legacyHTTPStatusMapping)
+	}
+}
+
+func cloneStatusMapping(m map[codes.Code]int) map[codes.Code]int {
+	clone := make(map[codes.Code]int, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// SetHTTPStatusMapping overrides the HTTP status that HTTPStatusFromCode
+// returns for code, without replacing HTTPStatusFromCode or HTTPError
+// wholesale. Like SetMappingProfile, call it during initialization, before
+// any ServeMux starts handling requests.
+func SetHTTPStatusMapping(code codes.Code, status int) {
+	httpStatusMappingMu.Lock()
+	defer httpStatusMappingMu.Unlock()
+	HTTPStatusMapping[code] = status
+}
+
 // HTTPStatusFromCode converts a gRPC error code into the corresponding HTTP response status.
 func HTTPStatusFromCode(code codes.Code) int {
-	switch code {
-	case codes.OK:
-		return http.StatusOK
-	case codes.Canceled:
-		return http.StatusRequestTimeout
-	case codes.Unknown:
-		return http.StatusInternalServerError
-	case codes.InvalidArgument:
-		return http.StatusBadRequest
-	case codes.DeadlineExceeded:
-		return http.StatusRequestTimeout
-	case codes.NotFound:
-		return http.StatusNotFound
-	case codes.AlreadyExists:
-		return http.StatusConflict
-	case codes.PermissionDenied:
-		return http.StatusForbidden
-	case codes.Unauthenticated:
-		return http.StatusUnauthorized
-	case codes.ResourceExhausted:
-		return http.StatusForbidden
-	case codes.FailedPrecondition:
-		return http.StatusPreconditionFailed
-	case codes.Aborted:
-		return http.StatusConflict
-	case codes.OutOfRange:
-		return http.StatusBadRequest
-	case codes.Unimplemented:
-		return http.StatusNotImplemented
-	case codes.Internal:
-		return http.StatusInternalServerError
-	case codes.Unavailable:
-		return http.StatusServiceUnavailable
-	case codes.DataLoss:
-		return http.StatusInternalServerError
+	httpStatusMappingMu.RLock()
+	status, ok := HTTPStatusMapping[code]
+	httpStatusMappingMu.RUnlock()
+	if ok {
+		return status
 	}
 
 	grpclog.Printf("Unknown gRPC error code: %v", code)
 	return http.StatusInternalServerError
 }
 
+// HTTPStatusCoder is implemented by application error types that want to
+// choose the HTTP status DefaultHTTPError writes for them directly, instead
+// of relying on the HTTPStatusMapping table for their gRPC code. If err (or
+// any error in its errors.Unwrap chain) implements HTTPStatusCoder, its
+// value wins.
+type HTTPStatusCoder interface {
+	HTTPStatus() int
+}
+
+// httpStatusFromError picks the HTTP status DefaultHTTPError should write for
+// err, which carries gRPC code code: an HTTPStatusCoder found by walking
+// err's errors.Unwrap chain takes precedence over the HTTPStatusMapping
+// table.
+func httpStatusFromError(err error, code codes.Code) int {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if coder, ok := e.(HTTPStatusCoder); ok {
+			return coder.HTTPStatus()
+		}
+	}
+	return HTTPStatusFromCode(code)
+}
+
+// HTTPStatusToCode converts an HTTP response status into the gRPC error code
+// it most likely originated from. It is the inverse of HTTPStatusFromCode,
+// needed when a ServeMux fronts a downstream REST endpoint (or embeds a
+// plain http.Handler) whose non-gRPC error responses must flow back through
+// the same HTTPError pipeline as a native gRPC error instead of collapsing
+// to codes.Unknown.
+func HTTPStatusToCode(status int) codes.Code {
+	switch status {
+	case http.StatusOK:
+		return codes.OK
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusInternalServerError:
+		return codes.Internal
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case 499: // client closed request; googleAPIsHTTPStatusMapping's status for codes.Canceled
+		return codes.Canceled
+	}
+
+	grpclog.Printf("Unknown HTTP status: %v", status)
+	return codes.Unknown
+}
+
+// StatusFromHTTPResponse builds a *status.Status for the gRPC code implied by
+// resp.StatusCode, so a downstream REST error can be translated into a
+// proper gRPC status. reason and metadata, if non-empty, populate an
+// errdetails.ErrorInfo on the returned status, mirroring the information a
+// native gRPC backend would attach.
+func StatusFromHTTPResponse(resp *http.Response, reason string, metadata map[string]string) *status.Status {
+	s := status.New(HTTPStatusToCode(resp.StatusCode), http.StatusText(resp.StatusCode))
+	if reason == "" && len(metadata) == 0 {
+		return s
+	}
+
+	info := &errdetails.ErrorInfo{Reason: reason, Metadata: metadata}
+	if resp.Request != nil && resp.Request.URL != nil {
+		info.Domain = resp.Request.URL.Host
+	}
+	ds, err := s.WithDetails(info)
+	if err != nil {
+		grpclog.Printf("Failed to attach ErrorInfo to translated status: %v", err)
+		return s
+	}
+	return ds
+}
+
+// ErrorFromHTTPResponse translates resp into a gRPC error suitable for
+// passing straight to HTTPError, so a ServeMux that proxies to a downstream
+// REST endpoint can surface that endpoint's errors the same way it surfaces
+// errors from its gRPC backends.
+func ErrorFromHTTPResponse(resp *http.Response, reason string, metadata map[string]string) error {
+	return StatusFromHTTPResponse(resp, reason, metadata).Err()
+}
+
 var (
 	// HTTPError replies to the request with the error.
 	// You can set a custom function to this variable to customize error format.
@@ -162,6 +350,143 @@ var (
 	OtherErrorHandler = DefaultOtherErrorHandler
 )
 
+// errorDetailRegistry maps the type URL anypb.New/ptypes.MarshalAny would
+// produce for a detail message (e.g. "type.googleapis.com/google.rpc.BadRequest")
+// to a constructor for that message's concrete Go type, so ErrorFromResponse
+// can decode an Any detail back into it instead of leaving it opaque.
+var errorDetailRegistry = map[string]func() proto.Message{}
+
+// errorDetailRegistryMu guards errorDetailRegistry against the concurrent
+// read (ErrorFromResponse) and write (RegisterErrorDetail) that would
+// otherwise race once a ServeMux is serving requests while another
+// goroutine registers another detail type.
+var errorDetailRegistryMu sync.RWMutex
+
+// RegisterErrorDetail registers msg's concrete type under typeURL so
+// ErrorFromResponse can reconstitute details of that type. Call it once per
+// detail type during initialization, passing a zero value of the message,
+// e.g. RegisterErrorDetail("type.googleapis.com/google.rpc.BadRequest", &errdetails.BadRequest{}).
+func RegisterErrorDetail(typeURL string, msg proto.Message) {
+	t := reflect.TypeOf(msg).Elem()
+
+	errorDetailRegistryMu.Lock()
+	defer errorDetailRegistryMu.Unlock()
+	errorDetailRegistry[typeURL] = func() proto.Message {
+		return reflect.New(t).Interface().(proto.Message)
+	}
+}
+
+// errorDetailConstructor looks up the constructor RegisterErrorDetail
+// registered for typeURL, if any.
+func errorDetailConstructor(typeURL string) (func() proto.Message, bool) {
+	errorDetailRegistryMu.RLock()
+	defer errorDetailRegistryMu.RUnlock()
+	ctor, ok := errorDetailRegistry[typeURL]
+	return ctor, ok
+}
+
+// ErrorDetailer is implemented by application error types that carry extra
+// google.rpc.Status detail messages (errdetails.BadRequest, a custom type,
+// ...) they want attached to the status DefaultHTTPError emits. An error
+// whose GRPCStatus() already carries *anypb.Any details (the common case for
+// errors built with status.New().WithDetails()) needs no such interface;
+// those pass through as-is.
+type ErrorDetailer interface {
+	ErrorDetails() []proto.Message
+}
+
+// errorDetails collects the extra detail messages attached to err (or any
+// error in its errors.Unwrap chain) via ErrorDetailer.
+func errorDetails(err error) []proto.Message {
+	var details []proto.Message
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if provider, ok := e.(ErrorDetailer); ok {
+			details = append(details, provider.ErrorDetails()...)
+		}
+	}
+	return details
+}
+
+// ErrorDetail wraps a detail message decoded by ErrorFromResponse so it can
+// be recovered from the returned error with errors.As, e.g.
+//
+//	var d *runtime.ErrorDetail
+//	if errors.As(err, &d) {
+//		if br, ok := d.Message.(*errdetails.BadRequest); ok { ... }
+//	}
+type ErrorDetail struct {
+	Message proto.Message
+}
+
+func (d *ErrorDetail) Error() string { return d.Message.String() }
+
+// responseError is returned by ErrorFromResponse. It behaves like the
+// decoded status's own error for Error()/GRPCStatus() purposes, and exposes
+// any registered detail messages through Unwrap() []error.
+type responseError struct {
+	status  *status.Status
+	details []proto.Message
+}
+
+func (e *responseError) Error() string { return e.status.Err().Error() }
+
+func (e *responseError) GRPCStatus() *status.Status { return e.status }
+
+func (e *responseError) Unwrap() []error {
+	errs := make([]error, 0, len(e.details)+1)
+	errs = append(errs, e.status.Err())
+	for _, d := range e.details {
+		errs = append(errs, &ErrorDetail{Message: d})
+	}
+	return errs
+}
+
+// ErrorFromResponse reads the error envelope DefaultHTTPError writes to
+// resp.Body, decoded through marshaler (the same Marshaler the ServeMux
+// used to write it, e.g. &JSONPb{}), and reconstructs the gRPC error it
+// started from, so a typed Go error can survive a client -> gateway ->
+// backend -> gateway -> client round trip instead of being flattened to a
+// plain string. errorBody/errorInfo conform to proto.Message specifically
+// so a jsonpb-based marshaler renders their google.protobuf.Any details
+// with the "@type" convention; decoding with plain encoding/json instead
+// would leave every detail's type URL empty. Any detail whose type URL was
+// registered with RegisterErrorDetail is decoded into its concrete type and
+// can be recovered from the result with errors.As(err, &detail) where
+// detail is a *ErrorDetail.
+func ErrorFromResponse(resp *http.Response, marshaler Marshaler) error {
+	defer resp.Body.Close()
+
+	buf, rerr := ioutil.ReadAll(resp.Body)
+	if rerr != nil {
+		return ErrorFromHTTPResponse(resp, "", nil)
+	}
+
+	body := new(errorBody)
+	if err := marshaler.Unmarshal(buf, body); err != nil || body.Error == nil {
+		return ErrorFromHTTPResponse(resp, "", nil)
+	}
+
+	sp := &spb.Status{
+		Code:    body.Error.Code,
+		Message: body.Error.Message,
+		Details: body.Error.Details,
+	}
+	wrapped := &responseError{status: status.FromProto(sp)}
+	for _, any := range body.Error.Details {
+		ctor, ok := errorDetailConstructor(any.TypeUrl)
+		if !ok {
+			continue
+		}
+		msg := ctor()
+		if err := ptypes.UnmarshalAny(any, msg); err != nil {
+			grpclog.Printf("Failed to unmarshal error detail %s: %v", any.TypeUrl, err)
+			continue
+		}
+		wrapped.details = append(wrapped.details, msg)
+	}
+	return wrapped
+}
+
 type errorBody struct {
 	Error *errorInfo `protobuf:"bytes,1,name=error" json:"error"`
 }
@@ -189,7 +514,22 @@ func (*errorInfo) ProtoMessage()    {}
 //
 // The response body returned by this function is a JSON object,
 // which contains a member whose key is "error" and whose value is err.Error().
-func DefaultHTTPError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w http.ResponseWriter, _ *http.Request, err error) {
+//
+// Before rendering that default body, it first checks whether mux has an
+// ErrorHandlerFunc registered via WithErrorHandler for r's Accept header
+// (e.g. ProblemDetailsError for "application/problem+json") and, if so,
+// delegates to it instead.
+//
+// An HTTPStatusCoder found in err's errors.Unwrap chain overrides the status
+// HTTPStatusFromCode would give.
+func DefaultHTTPError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	if r != nil {
+		if handler, m, ok := lookupErrorHandler(mux, r); ok {
+			handler(ctx, mux, m, w, r, err)
+			return
+		}
+	}
+
 	const fallback = `{"error": "failed to marshal error message"}`
 
 	w.Header().Del("Trailer")
@@ -200,11 +540,21 @@ func DefaultHTTPError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w
 		s = status.New(codes.Unknown, err.Error())
 	}
 	sp := s.Proto()
+	httpStatus := httpStatusFromError(err, s.Code())
+	details := sp.Details
+	for _, d := range errorDetails(err) {
+		any, aerr := ptypes.MarshalAny(d)
+		if aerr != nil {
+			grpclog.Printf("Failed to marshal error detail %T: %v", d, aerr)
+			continue
+		}
+		details = append(details, any)
+	}
 	body := &errorBody{
 		Error: &errorInfo{
 			Code:    int32(sp.Code),
 			Message: sp.Message,
-			Details: sp.Details,
+			Details: details,
 			Status:  HTTPStatusStringFromCode(s.Code()),
 		},
 	}
@@ -226,7 +576,7 @@ func DefaultHTTPError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w
 
 	handleForwardResponseServerMetadata(w, mux, md)
 	handleForwardResponseTrailerHeader(w, md)
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(httpStatus)
 	if _, err := w.Write(buf); err != nil {
 		grpclog.Printf("Failed to write response: %v", err)
 	}
@@ -239,3 +589,193 @@ func DefaultHTTPError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w
 func DefaultOtherErrorHandler(w http.ResponseWriter, _ *http.Request, msg string, code int) {
 	http.Error(w, msg, code)
 }
+
+// ErrorHandlerFunc has the same signature as HTTPError, but is registered
+// against a single ServeMux via WithErrorHandler instead of overriding the
+// package-wide default.
+type ErrorHandlerFunc func(ctx context.Context, mux *ServeMux, marshaler Marshaler, w http.ResponseWriter, r *http.Request, err error)
+
+// errorHandlerEntry pairs the content type an Accept header must match with
+// the marshaler/handler that should render the error body for it.
+type errorHandlerEntry struct {
+	contentType string
+	marshaler   Marshaler
+	handler     ErrorHandlerFunc
+}
+
+// errorHandlersMu guards errorHandlersByMux.
+var errorHandlersMu sync.RWMutex
+
+// errorHandlersByMux holds the registry WithErrorHandler populates, keyed by
+// the *ServeMux it was passed to. DefaultHTTPError consults it before
+// falling back to its own {"error": {...}} rendering, so the registry
+// takes effect through the same HTTPError variable every caller already
+// exercises, without requiring a field on the ServeMux struct itself.
+var errorHandlersByMux = map[*ServeMux][]errorHandlerEntry{}
+
+// WithErrorHandler registers handler to render errors for requests whose
+// Accept header matches contentType (e.g. "application/problem+json" for
+// ProblemDetailsError), scoped to the ServeMux it is passed to. Several
+// calls may be chained to offer more than one error format side by side;
+// the first registered entry whose contentType the request accepts wins,
+// and DefaultHTTPError's {"error": {...}} shape remains the fallback when
+// nothing matches.
+func WithErrorHandler(contentType string, marshaler Marshaler, handler ErrorHandlerFunc) ServeMuxOption {
+	return func(mux *ServeMux) {
+		errorHandlersMu.Lock()
+		defer errorHandlersMu.Unlock()
+		errorHandlersByMux[mux] = append(errorHandlersByMux[mux], errorHandlerEntry{
+			contentType: contentType,
+			marshaler:   marshaler,
+			handler:     handler,
+		})
+	}
+}
+
+// lookupErrorHandler returns the ErrorHandlerFunc and Marshaler of the first
+// entry registered for mux via WithErrorHandler whose contentType r's Accept
+// header accepts, if any. Accept q-values are not taken into account.
+func lookupErrorHandler(mux *ServeMux, r *http.Request) (ErrorHandlerFunc, Marshaler, bool) {
+	errorHandlersMu.RLock()
+	defer errorHandlersMu.RUnlock()
+
+	accept := r.Header.Get("Accept")
+	for _, e := range errorHandlersByMux[mux] {
+		if acceptsContentType(accept, e.contentType) {
+			return e.handler, e.marshaler, true
+		}
+	}
+	return nil, nil, false
+}
+
+// acceptsContentType reports whether accept, an HTTP Accept header value,
+// includes contentType. A missing header is treated as accepting nothing
+// beyond the default; "*/*" is treated as accepting everything.
+func acceptsContentType(accept, contentType string) bool {
+	if accept == "" {
+		return false
+	}
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if part == "*/*" || part == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// problemDetails is the application/problem+json body described by RFC 7807,
+// derived from a gRPC status. Any errdetails.* messages attached to the
+// status are surfaced under the "details" extension member.
+type problemDetails struct {
+	Type       string                 `json:"type,omitempty"`
+	Title      string                 `json:"title"`
+	Status     int                    `json:"status"`
+	Detail     string                 `json:"detail,omitempty"`
+	Instance   string                 `json:"instance,omitempty"`
+	Code       int32                  `json:"code"`
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens p's RFC 7807 extension members into the top-level
+// object alongside its standard fields, as the spec requires.
+func (p *problemDetails) MarshalJSON() ([]byte, error) {
+	type alias problemDetails
+	buf, err := json.Marshal((*alias)(p))
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Extensions) == 0 {
+		return buf, nil
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range p.Extensions {
+		eb, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = eb
+	}
+	return json.Marshal(m)
+}
+
+// ProblemDetailsError is an ErrorHandlerFunc that renders err as an RFC 7807
+// application/problem+json body instead of the {"error": {...}} shape used
+// by DefaultHTTPError. Register it with WithErrorHandler, e.g.
+// WithErrorHandler("application/problem+json", &JSONPb{}, ProblemDetailsError),
+// to offer it to clients that send a matching Accept header.
+func ProblemDetailsError(ctx context.Context, mux *ServeMux, marshaler Marshaler, w http.ResponseWriter, _ *http.Request, err error) {
+	const fallback = `{"title": "failed to marshal error message", "status": 500}`
+
+	w.Header().Del("Trailer")
+	w.Header().Set("Content-Type", "application/problem+json")
+
+	s, ok := status.FromError(err)
+	if !ok {
+		s = status.New(codes.Unknown, err.Error())
+	}
+	httpStatus := httpStatusFromError(err, s.Code())
+
+	pd := &problemDetails{
+		Title:  HTTPStatusStringFromCode(s.Code()),
+		Status: httpStatus,
+		Detail: s.Message(),
+		Code:   int32(s.Code()),
+	}
+
+	details := s.Proto().Details
+	for _, d := range errorDetails(err) {
+		any, aerr := ptypes.MarshalAny(d)
+		if aerr != nil {
+			grpclog.Printf("Failed to marshal error detail %T: %v", d, aerr)
+			continue
+		}
+		details = append(details, any)
+	}
+	if len(details) > 0 {
+		// Render each detail through marshaler (the same jsonpb-based
+		// Marshaler ProblemDetailsError was registered with) so errdetails.*
+		// messages appear as expanded {"@type": ..., ...} members, matching
+		// DefaultHTTPError's rendering instead of dumping the raw Any struct.
+		rendered := make([]json.RawMessage, 0, len(details))
+		for _, any := range details {
+			db, derr := marshaler.Marshal(any)
+			if derr != nil {
+				grpclog.Printf("Failed to marshal error detail %s: %v", any.TypeUrl, derr)
+				continue
+			}
+			rendered = append(rendered, json.RawMessage(db))
+		}
+		if len(rendered) > 0 {
+			pd.Extensions = map[string]interface{}{"details": rendered}
+		}
+	}
+
+	buf, merr := json.Marshal(pd)
+	if merr != nil {
+		grpclog.Printf("Failed to marshal problem details %v: %v", pd, merr)
+		w.WriteHeader(http.StatusInternalServerError)
+		if _, err := io.WriteString(w, fallback); err != nil {
+			grpclog.Printf("Failed to write response: %v", err)
+		}
+		return
+	}
+
+	md, ok := ServerMetadataFromContext(ctx)
+	if !ok {
+		grpclog.Printf("Failed to extract ServerMetadata from context")
+	}
+
+	handleForwardResponseServerMetadata(w, mux, md)
+	handleForwardResponseTrailerHeader(w, md)
+	w.WriteHeader(httpStatus)
+	if _, err := w.Write(buf); err != nil {
+		grpclog.Printf("Failed to write response: %v", err)
+	}
+
+	handleForwardResponseTrailer(w, md)
+}
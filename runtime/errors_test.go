@@ -0,0 +1,138 @@
+package runtime
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkHTTPStatusCodeRoundTrip asserts that HTTPStatusToCode(HTTPStatusFromCode(c))
+// returns c again for every code currently in HTTPStatusMapping, except the
+// codes in lossy that are known to collapse onto another code's HTTP status
+// under whichever MappingProfile is active.
+func checkHTTPStatusCodeRoundTrip(t *testing.T, lossy map[codes.Code]codes.Code) {
+	t.Helper()
+
+	for code := range HTTPStatusMapping {
+		httpStatus := HTTPStatusFromCode(code)
+		got := HTTPStatusToCode(httpStatus)
+		if got == code {
+			continue
+		}
+		if want, ok := lossy[code]; ok && got == want {
+			continue
+		}
+		t.Errorf("HTTPStatusToCode(HTTPStatusFromCode(%v)) = %v, want %v (via HTTP %d)", code, got, code, httpStatus)
+	}
+}
+
+// TestHTTPStatusCodeRoundTrip checks code -> http -> code stability under
+// both mapping profiles, restoring ProfileLegacy afterwards since that is
+// the package default.
+func TestHTTPStatusCodeRoundTrip(t *testing.T) {
+	defer SetMappingProfile(ProfileLegacy)
+
+	SetMappingProfile(ProfileLegacy)
+	t.Run("legacy", func(t *testing.T) {
+		checkHTTPStatusCodeRoundTrip(t, map[codes.Code]codes.Code{
+			codes.Unknown:           codes.Internal,
+			codes.DataLoss:          codes.Internal,
+			codes.Canceled:          codes.DeadlineExceeded,
+			codes.ResourceExhausted: codes.PermissionDenied,
+			codes.OutOfRange:        codes.InvalidArgument,
+			codes.Aborted:           codes.AlreadyExists,
+		})
+	})
+
+	SetMappingProfile(ProfileGoogleAPIs)
+	t.Run("google_apis", func(t *testing.T) {
+		checkHTTPStatusCodeRoundTrip(t, map[codes.Code]codes.Code{
+			codes.Unknown:            codes.Internal,
+			codes.DataLoss:           codes.Internal,
+			codes.FailedPrecondition: codes.InvalidArgument,
+			codes.OutOfRange:         codes.InvalidArgument,
+			codes.Aborted:            codes.AlreadyExists,
+		})
+	})
+}
+
+// TestAcceptsContentType exercises the Accept-header matching lookupErrorHandler
+// uses to pick a WithErrorHandler registration for a request.
+func TestAcceptsContentType(t *testing.T) {
+	cases := []struct {
+		accept      string
+		contentType string
+		want        bool
+	}{
+		{"", "application/problem+json", false},
+		{"application/json", "application/problem+json", false},
+		{"application/problem+json", "application/problem+json", true},
+		{"text/html, application/problem+json;q=0.9", "application/problem+json", true},
+		{"*/*", "application/problem+json", true},
+	}
+	for _, c := range cases {
+		if got := acceptsContentType(c.accept, c.contentType); got != c.want {
+			t.Errorf("acceptsContentType(%q, %q) = %v, want %v", c.accept, c.contentType, got, c.want)
+		}
+	}
+}
+
+// detailedStatusError is a minimal error implementing both GRPCStatus (so
+// status.FromError recognizes it) and ErrorDetailer (so DefaultHTTPError
+// attaches its details), used only to exercise the round trip below.
+type detailedStatusError struct {
+	status  *status.Status
+	details []proto.Message
+}
+
+func (e *detailedStatusError) Error() string              { return e.status.Err().Error() }
+func (e *detailedStatusError) GRPCStatus() *status.Status { return e.status }
+func (e *detailedStatusError) ErrorDetails() []proto.Message {
+	return e.details
+}
+
+// TestErrorDetailRoundTrip drives a typed error detail through
+// DefaultHTTPError and back through ErrorFromResponse using the real JSONPb
+// marshaler on both ends, so the Any details travel over the wire in
+// jsonpb's "@type" form rather than the plain-JSON type_url/value form, and
+// recovers the detail with errors.As the way RegisterErrorDetail is meant
+// to be used.
+func TestErrorDetailRoundTrip(t *testing.T) {
+	RegisterErrorDetail("type.googleapis.com/google.rpc.BadRequest", &errdetails.BadRequest{})
+
+	br := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "name", Description: "required"},
+		},
+	}
+	origErr := &detailedStatusError{
+		status:  status.New(codes.InvalidArgument, "bad input"),
+		details: []proto.Message{br},
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	marshaler := &JSONPb{}
+	DefaultHTTPError(context.Background(), NewServeMux(), marshaler, rec, req, origErr)
+
+	got := ErrorFromResponse(rec.Result(), marshaler)
+
+	var detail *ErrorDetail
+	if !errors.As(got, &detail) {
+		t.Fatalf("errors.As(%v, &detail) found no *ErrorDetail", got)
+	}
+	gotBR, ok := detail.Message.(*errdetails.BadRequest)
+	if !ok {
+		t.Fatalf("decoded detail has type %T, want *errdetails.BadRequest", detail.Message)
+	}
+	if len(gotBR.FieldViolations) != 1 || gotBR.FieldViolations[0].Field != "name" {
+		t.Fatalf("unexpected decoded detail: %+v", gotBR)
+	}
+}